@@ -0,0 +1,133 @@
+package jsql
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+// A BindStyle identifies the placeholder syntax a database/sql driver
+// expects for bound parameters, following the same split as
+// jmoiron/sqlx's bind.go.
+type BindStyle int
+
+const (
+	// UNKNOWN means no BindStyle has been registered for the driver;
+	// PositionalQueryVars decides the fallback (DOLLAR or QUESTION).
+	UNKNOWN BindStyle = iota
+	QUESTION
+	DOLLAR
+	NAMED
+	AT
+)
+
+// bindStyles maps a driver name, as produced by driverName, to the
+// BindStyle it expects. It is pre-populated with the drivers we know
+// about; RegisterBindType adds to it.
+var (
+	bindStylesMu sync.RWMutex
+	bindStyles   = map[string]BindStyle{
+		"pq":        DOLLAR, // github.com/lib/pq
+		"pgx":       DOLLAR, // github.com/jackc/pgx/stdlib
+		"mysql":     QUESTION,
+		"sqlite3":   QUESTION,
+		"mssql":     AT,    // github.com/denisenkom/go-mssqldb
+		"sqlserver": AT,    // github.com/microsoft/go-mssqldb
+		"godror":    NAMED, // oracle
+		"goracle":   NAMED,
+	}
+)
+
+// RegisterBindType records the BindStyle to use for a driver, keyed by
+// the name DriverName would derive for it. Use this for drivers not
+// known to this package, or to override a default.
+func RegisterBindType(driver string, style BindStyle) {
+	bindStylesMu.Lock()
+	defer bindStylesMu.Unlock()
+	bindStyles[driver] = style
+}
+
+func lookupBindType(driver string) (BindStyle, bool) {
+	bindStylesMu.RLock()
+	defer bindStylesMu.RUnlock()
+	style, ok := bindStyles[driver]
+	return style, ok
+}
+
+// driverNames maps a driver.Driver value to the name it was registered
+// under with sql.Register, as recorded by Open or RegisterDriverName.
+// DriverName consults this before falling back to guessing from the
+// driver's package path, which is often wrong: jackc/pgx's stdlib
+// driver, for instance, lives in a package called "stdlib", not "pgx".
+var (
+	driverNamesMu sync.RWMutex
+	driverNames   = map[driver.Driver]string{}
+)
+
+// Open is a drop-in replacement for sql.Open that also remembers
+// driverName, so DriverName (and therefore bindStyle) reports it
+// accurately instead of guessing from the driver value's package path --
+// the same problem jmoiron/sqlx's Open solves for its own bind-type
+// detection. Prefer this over sql.Open whenever the registered driver
+// name doesn't match its package's name, e.g. "pgx" (registered from
+// github.com/jackc/pgx/stdlib) or "sqlite3" (registered from
+// github.com/mattn/go-sqlite3).
+func Open(driverName, dataSourceName string) (*sql.DB, error) {
+	db, err := sql.Open(driverName, dataSourceName)
+	if err != nil {
+		return nil, err
+	}
+	RegisterDriverName(db.Driver(), driverName)
+	return db, nil
+}
+
+// RegisterDriverName records the name d was registered under with
+// sql.Register, for a *sql.DB obtained some other way than Open (e.g. an
+// existing sql.Open call, or a *sql.DB built from a driver.Connector).
+func RegisterDriverName(d driver.Driver, name string) {
+	driverNamesMu.Lock()
+	defer driverNamesMu.Unlock()
+	driverNames[d] = name
+}
+
+// DriverName reports the name d was registered under with sql.Register,
+// if it was opened via Open or announced with RegisterDriverName; failing
+// that, it falls back to guessing from d's package path, e.g. the driver
+// registered by "github.com/lib/pq" becomes "pq". The fallback is a
+// guess, not a guarantee -- it matches the name registered with
+// sql.Register only when the driver's Go package happens to share it.
+// This is the name RegisterBindType expects, and DriverName is exported
+// so callers can register styles for their own drivers.
+func DriverName(d driver.Driver) string {
+	driverNamesMu.RLock()
+	name, ok := driverNames[d]
+	driverNamesMu.RUnlock()
+	if ok {
+		return name
+	}
+
+	t := reflect.TypeOf(d)
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	pkg := t.PkgPath()
+	if i := strings.LastIndex(pkg, "/"); i >= 0 {
+		pkg = pkg[i+1:]
+	}
+	return pkg
+}
+
+// bindStyle picks the BindStyle to use for queries run against db: the
+// style registered for its driver, or the PositionalQueryVars default
+// for drivers we don't recognize.
+func bindStyle(db *sql.DB) BindStyle {
+	if style, ok := lookupBindType(DriverName(db.Driver())); ok {
+		return style
+	}
+	if PositionalQueryVars {
+		return DOLLAR
+	}
+	return QUESTION
+}
@@ -0,0 +1,35 @@
+package jsql
+
+import (
+	"database/sql/driver"
+	"testing"
+)
+
+// fakeDriver is a minimal driver.Driver whose package path
+// ("github.com/lvdlvd/go-jsql", last segment "go-jsql") doesn't match
+// any name bindStyles knows about, standing in for real drivers like
+// jackc/pgx/stdlib whose package name differs from the name they're
+// registered under with sql.Register.
+type fakeDriver struct{}
+
+func (fakeDriver) Open(name string) (driver.Conn, error) { return nil, nil }
+
+func TestDriverNameFallsBackToPackagePath(t *testing.T) {
+	if got, want := DriverName(fakeDriver{}), "go-jsql"; got != want {
+		t.Errorf("DriverName(fakeDriver{}) = %q, want %q", got, want)
+	}
+}
+
+func TestRegisterDriverNameOverridesFallback(t *testing.T) {
+	d := fakeDriver{}
+	RegisterDriverName(d, "pgx")
+	t.Cleanup(func() {
+		driverNamesMu.Lock()
+		delete(driverNames, d)
+		driverNamesMu.Unlock()
+	})
+
+	if got, want := DriverName(d), "pgx"; got != want {
+		t.Errorf("DriverName after RegisterDriverName(d, %q) = %q, want %q", want, got, want)
+	}
+}
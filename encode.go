@@ -0,0 +1,170 @@
+package jsql
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// An Encoder writes a query's results out to w in some wire format.
+// WriteHeader is called once, with the query's column names in order,
+// before the first row; WriteRow once per row; WriteFooter once after
+// the last row. An Encoder is used for a single query and is not safe
+// for concurrent use -- get a fresh one from its factory per query.
+type Encoder interface {
+	WriteHeader(cols []string, w io.Writer) error
+	WriteRow(row map[string]interface{}, w io.Writer) error
+	WriteFooter(w io.Writer) error
+}
+
+var (
+	encodersMu sync.RWMutex
+	encoders   = map[string]func() Encoder{
+		"application/json":     func() Encoder { return &jsonEncoder{} },
+		"application/x-ndjson": func() Encoder { return &ndjsonEncoder{} },
+		"text/csv":             func() Encoder { return &csvEncoder{} },
+	}
+)
+
+// RegisterEncoder adds, or replaces, the Encoder used for mimeType.
+// MkHandler and MkHandlerContext pick an encoder by matching the
+// request's Accept header against this registry.
+func RegisterEncoder(mimeType string, newEncoder func() Encoder) {
+	encodersMu.Lock()
+	defer encodersMu.Unlock()
+	encoders[mimeType] = newEncoder
+}
+
+func lookupEncoder(mimeType string) (func() Encoder, bool) {
+	encodersMu.RLock()
+	defer encodersMu.RUnlock()
+	f, ok := encoders[mimeType]
+	return f, ok
+}
+
+// negotiateEncoder picks an Encoder for the given Accept header value,
+// honouring q-values, and falls back to application/json if accept is
+// empty, unparseable, or names nothing we have an Encoder for.
+func negotiateEncoder(accept string) (mimeType string, enc Encoder) {
+	const fallback = "application/json"
+
+	type candidate struct {
+		mime string
+		q    float64
+	}
+
+	var candidates []candidate
+	for _, part := range strings.Split(accept, ",") {
+		fields := strings.Split(part, ";")
+		mime := strings.TrimSpace(fields[0])
+		if mime == "" {
+			continue
+		}
+		q := 1.0
+		for _, f := range fields[1:] {
+			f = strings.TrimSpace(f)
+			if strings.HasPrefix(f, "q=") {
+				if parsed, err := strconv.ParseFloat(f[len("q="):], 64); err == nil {
+					q = parsed
+				}
+			}
+		}
+		candidates = append(candidates, candidate{mime, q})
+	}
+	sort.SliceStable(candidates, func(i, j int) bool { return candidates[i].q > candidates[j].q })
+
+	for _, c := range candidates {
+		if c.mime == "*/*" {
+			break
+		}
+		if f, ok := lookupEncoder(c.mime); ok {
+			return c.mime, f()
+		}
+	}
+	f, _ := lookupEncoder(fallback)
+	return fallback, f()
+}
+
+// jsonEncoder reproduces Q's original output: a single JSON array of
+// row objects.
+type jsonEncoder struct{ n int }
+
+func (e *jsonEncoder) WriteHeader(cols []string, w io.Writer) error {
+	_, err := w.Write([]byte("[\n"))
+	return err
+}
+
+func (e *jsonEncoder) WriteRow(row map[string]interface{}, w io.Writer) error {
+	if e.n > 0 {
+		if _, err := w.Write([]byte(",\n")); err != nil {
+			return err
+		}
+	}
+	b, err := json.Marshal(row)
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(b); err != nil {
+		return err
+	}
+	e.n++
+	return nil
+}
+
+func (e *jsonEncoder) WriteFooter(w io.Writer) error {
+	_, err := w.Write([]byte("\n]"))
+	return err
+}
+
+// ndjsonEncoder writes newline-delimited JSON: one object per line, with
+// no enclosing array, so a large result set can be processed as it
+// arrives (e.g. by jq or a line-oriented reader) instead of waiting for
+// the closing bracket.
+type ndjsonEncoder struct{}
+
+func (ndjsonEncoder) WriteHeader(cols []string, w io.Writer) error { return nil }
+
+func (ndjsonEncoder) WriteRow(row map[string]interface{}, w io.Writer) error {
+	b, err := json.Marshal(row)
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+	_, err = w.Write(b)
+	return err
+}
+
+func (ndjsonEncoder) WriteFooter(w io.Writer) error { return nil }
+
+// csvEncoder writes the columns as a header row, then one row per
+// record, in the column order given to WriteHeader.
+type csvEncoder struct {
+	cols []string
+	cw   *csv.Writer
+}
+
+func (e *csvEncoder) WriteHeader(cols []string, w io.Writer) error {
+	e.cols = cols
+	e.cw = csv.NewWriter(w)
+	return e.cw.Write(cols)
+}
+
+func (e *csvEncoder) WriteRow(row map[string]interface{}, w io.Writer) error {
+	rec := make([]string, len(e.cols))
+	for i, c := range e.cols {
+		if v := row[c]; v != nil {
+			rec[i] = fmt.Sprint(v)
+		}
+	}
+	return e.cw.Write(rec)
+}
+
+func (e *csvEncoder) WriteFooter(w io.Writer) error {
+	e.cw.Flush()
+	return e.cw.Error()
+}
@@ -0,0 +1,24 @@
+package jsql
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestCSVEncoderWritesNullAsEmptyField(t *testing.T) {
+	var b bytes.Buffer
+	e := &csvEncoder{}
+	if err := e.WriteHeader([]string{"i", "s"}, &b); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.WriteRow(map[string]interface{}{"i": 1, "s": nil}, &b); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.WriteFooter(&b); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := b.String(), "i,s\n1,\n"; got != want {
+		t.Errorf("csvEncoder output = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,196 @@
+package jsql
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// varNames returns the distinct ${name}s referenced in q, in the order
+// they first appear, independent of bindvar style or arity. Handlers
+// use this to know which request parameters a query needs.
+func varNames(q string) []string {
+	idx := reVars.FindAllStringSubmatchIndex(q, -1)
+	seen := map[string]bool{}
+	var names []string
+	for _, v := range idx {
+		name := q[v[2]:v[3]]
+		if !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// sliceLen reports the length of v if it is a slice or array to be
+// expanded into an IN-clause style placeholder list. []byte is treated
+// as a scalar (e.g. a bytea/blob value), not a list.
+func sliceLen(v interface{}) (n int, ok bool) {
+	if v == nil {
+		return 0, false
+	}
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Slice:
+		if rv.Type().Elem().Kind() == reflect.Uint8 {
+			return 0, false
+		}
+		return rv.Len(), true
+	case reflect.Array:
+		return rv.Len(), true
+	}
+	return 0, false
+}
+
+// aritySignature turns an arity map into a stable cache key.
+func aritySignature(arity map[string]int) string {
+	names := make([]string, 0, len(arity))
+	for n := range arity {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	var b strings.Builder
+	for _, n := range names {
+		fmt.Fprintf(&b, "%s=%d;", n, arity[n])
+	}
+	return b.String()
+}
+
+// An argRef names where one positional (or named) parameter's value
+// comes from: args[name] itself if idx is negative, or element idx of
+// the slice at args[name] otherwise.
+type argRef struct {
+	name string
+	idx  int
+}
+
+// rewriteExpand is rewrite generalized to variable arity: arity should
+// hold an entry for every ${name} that was supplied as a slice/array,
+// giving the number of placeholders it expands to, so "IN (${ids})"
+// with arity["ids"] == 3 becomes "IN ($1,$2,$3)" (DOLLAR), "IN (?,?,?)"
+// (QUESTION), or "IN (:ids_0,:ids_1,:ids_2)" (NAMED). A name missing
+// from arity is treated as a scalar, exactly as rewrite; a name present
+// with arity 1 is still a slice and gets indexed (":ids_0", not
+// ":ids") -- the two must not be conflated, or buildArgsExpand ends up
+// trying to bind a length-1 slice itself instead of its one element. A
+// name mapped to 0 (an empty slice) expands to the literal NULL instead
+// of any placeholder, so an empty IN-clause matches nothing rather than
+// producing invalid SQL.
+func rewriteExpand(q string, style BindStyle, arity map[string]int) (qq string, argn []argRef) {
+	if style == UNKNOWN {
+		if PositionalQueryVars {
+			style = DOLLAR
+		} else {
+			style = QUESTION
+		}
+	}
+	idx := reVars.FindAllStringSubmatchIndex(q, -1)
+	l := 0
+	var b bytes.Buffer
+	positions := map[string][]int{} // name -> 1-based positions already assigned, for DOLLAR/AT dedup
+	for _, v := range idx {
+		b.WriteString(q[l:v[0]])
+		l = v[1]
+		name := q[v[2]:v[3]]
+		n, inArity := arity[name]
+		switch {
+		case !inArity:
+			n = 1
+		case n == 0:
+			// An empty slice/array expands to no placeholders at all;
+			// NULL makes the IN-clause well-formed while matching nothing.
+			b.WriteString("NULL")
+			continue
+		}
+
+		switch style {
+		case DOLLAR, AT:
+			posns, ok := positions[name]
+			if !ok {
+				posns = make([]int, n)
+				for i := 0; i < n; i++ {
+					argn = append(argn, argRef{name: name, idx: sliceIdx(inArity, i)})
+					posns[i] = len(argn)
+				}
+				positions[name] = posns
+			}
+			for i, p := range posns {
+				if i > 0 {
+					b.WriteByte(',')
+				}
+				if style == AT {
+					fmt.Fprintf(&b, "@p%d", p)
+				} else {
+					fmt.Fprintf(&b, "$%d", p)
+				}
+			}
+		case NAMED:
+			for i := 0; i < n; i++ {
+				if i > 0 {
+					b.WriteByte(',')
+				}
+				sidx := sliceIdx(inArity, i)
+				argn = append(argn, argRef{name: name, idx: sidx})
+				if sidx < 0 {
+					fmt.Fprintf(&b, ":%s", name)
+				} else {
+					fmt.Fprintf(&b, ":%s_%d", name, sidx)
+				}
+			}
+		default: // QUESTION
+			for i := 0; i < n; i++ {
+				if i > 0 {
+					b.WriteByte(',')
+				}
+				b.WriteByte('?')
+				argn = append(argn, argRef{name: name, idx: sliceIdx(inArity, i)})
+			}
+		}
+	}
+	b.WriteString(q[l:])
+	return b.String(), argn
+}
+
+// sliceIdx returns -1 (meaning "use args[name] directly, it's a scalar")
+// for a name that wasn't supplied as a slice/array, or the index to pull
+// out of that slice/array otherwise -- even when it has exactly one
+// element, since buildArgsExpand must still index into a real slice
+// rather than pass the slice itself as the bound value.
+func sliceIdx(inArity bool, i int) int {
+	if !inArity {
+		return -1
+	}
+	return i
+}
+
+// buildArgsExpand is buildArgs generalized to argRefs: it pulls each
+// value out of args, indexing into a slice-valued argument when the
+// argRef calls for it.
+func buildArgsExpand(style BindStyle, argn []argRef, args map[string]interface{}) ([]interface{}, error) {
+	var argv []interface{}
+	for _, ref := range argn {
+		val := args[ref.name]
+		name := ref.name
+		if ref.idx >= 0 {
+			rv := reflect.ValueOf(val)
+			if rv.Kind() != reflect.Slice && rv.Kind() != reflect.Array {
+				return nil, fmt.Errorf("jsql: %s: expected a slice or array, got %T", ref.name, val)
+			}
+			if ref.idx >= rv.Len() {
+				return nil, fmt.Errorf("jsql: %s: changed length between preparing and executing the query", ref.name)
+			}
+			val = rv.Index(ref.idx).Interface()
+			name = fmt.Sprintf("%s_%d", ref.name, ref.idx)
+		}
+		if style == NAMED {
+			argv = append(argv, sql.Named(name, val))
+		} else {
+			argv = append(argv, val)
+		}
+	}
+	return argv, nil
+}
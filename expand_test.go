@@ -0,0 +1,41 @@
+package jsql
+
+import "testing"
+
+func TestRewriteExpandSingleElementSlice(t *testing.T) {
+	q, argn := rewriteExpand("SELECT * FROM foo WHERE id IN (${ids})", QUESTION, map[string]int{"ids": 1})
+
+	if want := "SELECT * FROM foo WHERE id IN (?)"; q != want {
+		t.Errorf("query = %q, want %q", q, want)
+	}
+	if len(argn) != 1 || argn[0].idx != 0 {
+		t.Fatalf("argn = %+v, want a single argRef indexing element 0 of ids", argn)
+	}
+
+	argv, err := buildArgsExpand(QUESTION, argn, map[string]interface{}{"ids": []int{5}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(argv) != 1 || argv[0] != 5 {
+		t.Errorf("argv = %v, want [5] (the slice's one element, not the slice itself)", argv)
+	}
+}
+
+func TestRewriteExpandScalarStillUsesValueDirectly(t *testing.T) {
+	q, argn := rewriteExpand("SELECT * FROM foo WHERE id = ${id}", QUESTION, nil)
+
+	if want := "SELECT * FROM foo WHERE id = ?"; q != want {
+		t.Errorf("query = %q, want %q", q, want)
+	}
+	if len(argn) != 1 || argn[0].idx != -1 {
+		t.Fatalf("argn = %+v, want a single argRef using args[name] directly", argn)
+	}
+
+	argv, err := buildArgsExpand(QUESTION, argn, map[string]interface{}{"id": 7})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(argv) != 1 || argv[0] != 7 {
+		t.Errorf("argv = %v, want [7]", argv)
+	}
+}
@@ -3,6 +3,8 @@ package jsql
 
 import (
 	"bytes"
+	"container/list"
+	"context"
 	"database/sql"
 	"encoding/json"
 	"fmt"
@@ -11,6 +13,8 @@ import (
 	"mime"
 	"net/http"
 	"regexp"
+	"strings"
+	"sync"
 
 	"github.com/gorilla/mux"
 )
@@ -19,13 +23,20 @@ const jsonContentType = "application/json;charset=UTF-8"
 
 var reVars = regexp.MustCompile(`\${([^}]+)}`)
 
-// PositionalQueryVars controls wether
-// the generated query strings will use '?'
-// or $1, $2... syntax.
+// PositionalQueryVars controls wether the generated query strings will
+// use '?' or $1, $2... syntax for drivers with no BindStyle registered
+// via RegisterBindType. Known drivers (see bind.go) are unaffected.
 var PositionalQueryVars = true
 
 // TODO(lvd) less simplistic parsing of query.  worry about quoting etc.
-func rewrite(q string) (qq string, varnames []string) {
+func rewrite(q string, style BindStyle) (qq string, varnames []string) {
+	if style == UNKNOWN {
+		if PositionalQueryVars {
+			style = DOLLAR
+		} else {
+			style = QUESTION
+		}
+	}
 	idx := reVars.FindAllStringSubmatchIndex(q, -1)
 	l := 0
 	var pos = map[string]int{}
@@ -34,13 +45,21 @@ func rewrite(q string) (qq string, varnames []string) {
 		b.WriteString(q[l:v[0]])
 		l = v[1]
 		name := q[v[2]:v[3]]
-		if PositionalQueryVars {
+		switch style {
+		case DOLLAR, AT:
 			if _, ok := pos[name]; !ok {
 				varnames = append(varnames, name)
 				pos[name] = len(varnames)
 			}
-			b.WriteString(fmt.Sprintf("$%d", pos[name]))
-		} else {
+			if style == AT {
+				fmt.Fprintf(&b, "@p%d", pos[name])
+			} else {
+				fmt.Fprintf(&b, "$%d", pos[name])
+			}
+		case NAMED:
+			varnames = append(varnames, name)
+			fmt.Fprintf(&b, ":%s", name)
+		default: // QUESTION
 			varnames = append(varnames, name)
 			b.WriteString("?")
 		}
@@ -49,8 +68,198 @@ func rewrite(q string) (qq string, varnames []string) {
 	return b.String(), varnames
 }
 
-// TODO:make Q send records on a channel, and provide json/bson as encoders
-// then have the Handler switch returned encoding depending on http headers
+// buildArgs turns the values named by varnames out of args into the
+// positional argument list stmt.Query/Exec expect, in the encoding the
+// given BindStyle requires (NAMED drivers match arguments by name, so
+// they're wrapped in sql.Named instead of passed positionally).
+func buildArgs(style BindStyle, varnames []string, args map[string]interface{}) []interface{} {
+	var argv []interface{}
+	for _, v := range varnames {
+		if style == NAMED {
+			argv = append(argv, sql.Named(v, args[v]))
+		} else {
+			argv = append(argv, args[v])
+		}
+	}
+	return argv
+}
+
+// maxQueryVariants caps how many per-arity statements (see preparedArity)
+// a single queryStmt keeps prepared at once. Arity comes straight from
+// request-supplied slice lengths -- MkHandler accepts a JSON array body
+// or comma-separated form values for any ${name} -- so without a cap, a
+// handler exposed to the internet would prepare and hold open one
+// statement per distinct IN-list length it's ever seen, for the life of
+// the process.
+const maxQueryVariants = 64
+
+// queryStmt is a prepared statement together with the bindvar style and
+// argument names rewrite chose for it, shared by everything in this
+// package that runs a query or mutation: QContext, QTmplContext,
+// MkHandlerContext, Exec and MkMutationHandler.
+//
+// stmt/argn are prepared eagerly, treating every ${name} as a scalar --
+// this is the fast path, and it's what makes prepareQuery fail fast on
+// bad SQL the way it always has. When a call's args holds a slice for
+// one of the names, prepared defers to a statement prepared for that
+// slice's arity instead, caching it in variants for reuse, up to
+// maxQueryVariants at a time (least-recently-used evicted first).
+type queryStmt struct {
+	db    *sql.DB
+	style BindStyle
+
+	stmt *sql.Stmt
+	argn []string
+
+	rawQuery string
+	names    []string // distinct ${name}s in rawQuery, first-occurrence order
+
+	mu       sync.Mutex
+	variants map[string]*list.Element // arity signature -> element of lru
+	lru      *list.List               // *preparedArity, most recently used at the front
+}
+
+func prepareQuery(ctx context.Context, db *sql.DB, query string) (*queryStmt, error) {
+	style := bindStyle(db)
+	q, argn := rewrite(query, style)
+	stmt, err := db.PrepareContext(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+	return &queryStmt{
+		db: db, style: style,
+		stmt: stmt, argn: argn,
+		rawQuery: query, names: varNames(query),
+		variants: map[string]*list.Element{},
+		lru:      list.New(),
+	}, nil
+}
+
+// prepared resolves the *sql.Stmt and its already-ordered bound
+// arguments to run for args: the eagerly prepared scalar statement,
+// unless args holds a slice for one of the query's names, in which case
+// it expands to an IN-clause style placeholder list of the right arity
+// (see expand.go) using a statement prepared for that arity. Shared by
+// query (SELECT) and exec (INSERT/UPDATE/DELETE).
+func (qs *queryStmt) prepared(ctx context.Context, args map[string]interface{}) (*sql.Stmt, []interface{}, error) {
+	arity, ok := qs.sliceArity(args)
+	if !ok {
+		return qs.stmt, buildArgs(qs.style, qs.argn, args), nil
+	}
+	stmt, argn, err := qs.preparedForArity(ctx, arity)
+	if err != nil {
+		return nil, nil, err
+	}
+	argv, err := buildArgsExpand(qs.style, argn, args)
+	if err != nil {
+		return nil, nil, err
+	}
+	return stmt, argv, nil
+}
+
+// query runs the statement, expanding any name in args that holds a
+// slice into an IN-clause style placeholder list of the right arity
+// (see expand.go), and otherwise using the eagerly prepared scalar
+// statement.
+func (qs *queryStmt) query(ctx context.Context, args map[string]interface{}) (*sql.Rows, error) {
+	stmt, argv, err := qs.prepared(ctx, args)
+	if err != nil {
+		return nil, err
+	}
+	return stmt.QueryContext(ctx, argv...)
+}
+
+// exec is query's counterpart for INSERT/UPDATE/DELETE: same arity
+// expansion, run via ExecContext instead of QueryContext.
+func (qs *queryStmt) exec(ctx context.Context, args map[string]interface{}) (sql.Result, error) {
+	stmt, argv, err := qs.prepared(ctx, args)
+	if err != nil {
+		return nil, err
+	}
+	return stmt.ExecContext(ctx, argv...)
+}
+
+// sliceArity reports the length of every slice-valued argument named in
+// the query, or ok == false if args has none -- the common case, where
+// the eagerly prepared statement can be used unchanged.
+func (qs *queryStmt) sliceArity(args map[string]interface{}) (arity map[string]int, ok bool) {
+	for _, n := range qs.names {
+		if l, isSlice := sliceLen(args[n]); isSlice {
+			if arity == nil {
+				arity = map[string]int{}
+			}
+			arity[n] = l
+		}
+	}
+	return arity, arity != nil
+}
+
+// preparedArity is a statement prepared for one particular combination
+// of slice-argument lengths.
+type preparedArity struct {
+	sig  string
+	stmt *sql.Stmt
+	argn []argRef
+}
+
+func (qs *queryStmt) preparedForArity(ctx context.Context, arity map[string]int) (*sql.Stmt, []argRef, error) {
+	sig := aritySignature(arity)
+
+	qs.mu.Lock()
+	if el, ok := qs.variants[sig]; ok {
+		qs.lru.MoveToFront(el)
+		pa := el.Value.(*preparedArity)
+		qs.mu.Unlock()
+		return pa.stmt, pa.argn, nil
+	}
+	qs.mu.Unlock()
+
+	// arity names only the slice/array-valued args; rewriteExpand treats
+	// every other ${name} in the query as a scalar, which is correct --
+	// padding arity with a default of 1 for those names here would make
+	// a real length-1 slice indistinguishable from an absent one, and
+	// buildArgsExpand would bind the slice itself instead of its element.
+	q, argn := rewriteExpand(qs.rawQuery, qs.style, arity)
+	stmt, err := qs.db.PrepareContext(ctx, q)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	pa := &preparedArity{sig: sig, stmt: stmt, argn: argn}
+	qs.mu.Lock()
+	if el, ok := qs.variants[sig]; ok {
+		qs.lru.MoveToFront(el)
+		existing := el.Value.(*preparedArity)
+		qs.mu.Unlock()
+		stmt.Close()
+		return existing.stmt, existing.argn, nil
+	}
+	qs.variants[sig] = qs.lru.PushFront(pa)
+	evicted := qs.evictLocked()
+	qs.mu.Unlock()
+
+	// *sql.Stmt.Close blocks until any of its in-flight uses finish;
+	// closing evicted statements after releasing qs.mu keeps a slow
+	// in-flight query from stalling every other arity's lookups.
+	for _, e := range evicted {
+		e.stmt.Close()
+	}
+	return pa.stmt, pa.argn, nil
+}
+
+// evictLocked drops the least-recently-used prepared variant(s) until at
+// most maxQueryVariants remain, returning them for the caller to Close
+// once qs.mu is released. Callers must hold qs.mu.
+func (qs *queryStmt) evictLocked() []*preparedArity {
+	var evicted []*preparedArity
+	for qs.lru.Len() > maxQueryVariants {
+		el := qs.lru.Back()
+		pa := qs.lru.Remove(el).(*preparedArity)
+		delete(qs.variants, pa.sig)
+		evicted = append(evicted, pa)
+	}
+	return evicted
+}
 
 // A queryfunc is the type of function generated by Q.
 // It executes a query substituting arguments from the provided args map,
@@ -63,13 +272,19 @@ func rewrite(q string) (qq string, varnames []string) {
 // If n == 0, nothing, not even the opening bracket, will have been written to w,
 // and the header will not have been set, meaning it is not too late to call e.g.
 //
-//    http.Error(w, err.Error(), http.StatusInternalError)
+//	http.Error(w, err.Error(), http.StatusInternalError)
 //
 // otherwise the error will have to be tacked on to the already produced output or
 // reported out of band.  If any elements have been written the queryfunc will
 // always generate a proper closing bracket.
 type QueryFunc func(args map[string]interface{}, w io.Writer) (n int, err error)
 
+// A QueryCtxFunc is the type of function generated by QContext. It behaves
+// like a QueryFunc, but ctx is passed to the underlying stmt.QueryContext,
+// so a caller can cancel a query that is still streaming rows to w --
+// for example by passing an *http.Request's Context().
+type QueryCtxFunc func(ctx context.Context, args map[string]interface{}, w io.Writer) (n int, err error)
+
 // Q builds a function that can execute the query on a database given
 // a map of parameters, and writes the result as json to a writer.
 //
@@ -84,76 +299,56 @@ type QueryFunc func(args map[string]interface{}, w io.Writer) (n int, err error)
 // The generated json will be an array of objects, one per row where
 // each row object has keys named after the columns in the SQL query.
 //
+// If args[varname] is a slice or array (other than []byte), the
+// placeholder is expanded to one bound parameter per element instead of
+// one, so 'SELECT * FROM foo WHERE id IN (${ids})' with
+// args["ids"] = []int{1,2,3} becomes 'IN ($1,$2,$3)'. A name repeated
+// elsewhere in the query still gets de-duplicated into the same bound
+// parameter(s) for the DOLLAR and AT bindvar styles, same as a scalar;
+// for QUESTION and NAMED styles, repeated names are never de-duplicated,
+// slice or not.
+//
+// Q is a thin wrapper around QContext using context.Background().
 func Q(db *sql.DB, query string) (QueryFunc, error) {
-	q, argn := rewrite(query)
-	stmt, err := db.Prepare(q)
+	qf, err := QContext(context.Background(), db, query)
 	if err != nil {
 		return nil, err
 	}
-	return func(args map[string]interface{}, w io.Writer) (n int, err error) {
-		var argv []interface{}
-		for _, v := range argn {
-			argv = append(argv, args[v])
-		}
-		rows, err := stmt.Query(argv...)
-		if err != nil {
-			return 0, err
-		}
-		defer rows.Close()
-		retn, err := rows.Columns()
+	return func(args map[string]interface{}, w io.Writer) (int, error) {
+		return qf(context.Background(), args, w)
+	}, nil
+}
+
+// QContext is like Q, but ctx is used to prepare the statement, and the
+// returned QueryCtxFunc takes a ctx of its own for every query, so a
+// long-running query can be cancelled without waiting for it to finish
+// streaming.
+func QContext(ctx context.Context, db *sql.DB, query string) (QueryCtxFunc, error) {
+	qs, err := prepareQuery(ctx, db, query)
+	if err != nil {
+		return nil, err
+	}
+	return func(ctx context.Context, args map[string]interface{}, w io.Writer) (int, error) {
+		rows, err := qs.query(ctx, args)
 		if err != nil {
 			return 0, err
 		}
-
-		var (
-			retv  = make([]interface{}, len(retn))
-			retvv = make([]interface{}, len(retn))
-			retm  = make(map[string]interface{})
-		)
-		for i := range retv {
-			retvv[i] = &retv[i]
-			retm[retn[i]] = &retv[i]
-		}
-		for rows.Next() {
-			if err := rows.Scan(retvv...); err != nil {
-				return n, err
-			}
-			// convert []byte to strings, because json uuencodes []byte
-			for i, v := range retv {
-				if vv, ok := v.([]byte); ok {
-					retv[i] = string(vv)
-				}
-			}
-
-			b, err := json.Marshal(retm)
-			if err != nil {
-				return n, err
-			}
-
-			if n == 0 {
-				if rw, ok := w.(http.ResponseWriter); ok {
-					rw.Header().Set("Content-type", jsonContentType)
-				}
-				w.Write([]byte("[\n"))
-				defer w.Write([]byte("\n]"))
-			} else {
-				w.Write([]byte(",\n"))
-			}
-
-			w.Write(b)
-			n++
-		}
-
-		return n, rows.Err()
+		return stream(rows, &jsonEncoder{}, jsonContentType, w)
 	}, nil
 }
 
 // Handler is a convenience wrapper around MkHandler
 // that will die on error.
 func Handler(db *sql.DB, query string) http.Handler {
-	h, err := MkHandler(db, query)
+	return HandlerContext(context.Background(), db, query)
+}
+
+// HandlerContext is a convenience wrapper around MkHandlerContext
+// that will die on error.
+func HandlerContext(ctx context.Context, db *sql.DB, query string) http.Handler {
+	h, err := MkHandlerContext(ctx, db, query)
 	if err != nil {
-		log.Panicf("MkHandler(%q): %v", query, err)
+		log.Panicf("MkHandlerContext(%q): %v", query, err)
 	}
 	return h
 }
@@ -165,13 +360,29 @@ func Handler(db *sql.DB, query string) http.Handler {
 // input json object, depending on the requests content type, merged with
 // the "github.com/gorilla/mux".Vars(r), which take precedence
 // in case of name conflicts.
+//
+// MkHandler is a thin wrapper around MkHandlerContext using
+// context.Background() to prepare the statement; each request still runs
+// with its own r.Context(), so it is cancelled if the client disconnects.
 func MkHandler(db *sql.DB, query string) (http.Handler, error) {
-	_, names := rewrite(query)
+	return MkHandlerContext(context.Background(), db, query)
+}
 
-	qf, err := Q(db, query)
+// MkHandlerContext is like MkHandler, but ctx is used to prepare the
+// statement. Every request is run with its own r.Context() rather than
+// ctx, so that a query streaming rows to a client that disconnects
+// mid-response is cancelled instead of running to completion unread.
+//
+// The response format is chosen from the request's Accept header
+// (honouring q-values) against the Encoders registered with
+// RegisterEncoder, falling back to application/json when the header is
+// missing or matches nothing registered.
+func MkHandlerContext(ctx context.Context, db *sql.DB, query string) (http.Handler, error) {
+	qs, err := prepareQuery(ctx, db, query)
 	if err != nil {
 		return nil, err
 	}
+	names := qs.names
 
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		args := make(map[string]interface{})
@@ -194,6 +405,7 @@ func MkHandler(db *sql.DB, query string) (http.Handler, error) {
 			}
 		}
 		muxargs := mux.Vars(r)
+		r.ParseForm()
 		// TODO harden against malicious input
 		// for now we just rely on precedence: muxargs trum the others
 		// but this still allows arbitrary values to end up in the query parameters
@@ -202,9 +414,25 @@ func MkHandler(db *sql.DB, query string) (http.Handler, error) {
 				args[n] = v
 				continue
 			}
-			if v := r.FormValue(n); v != "" {
-				args[n] = v
-				continue
+			// A name used as an IN-clause (see expand.go) can be given as
+			// repeated form values (?id=1&id=2) or one comma-separated
+			// value (?id=1,2); either becomes a []string.
+			if vs, ok := r.Form[n]; ok && len(vs) > 0 {
+				switch {
+				case len(vs) > 1:
+					var flat []string
+					for _, v := range vs {
+						flat = append(flat, strings.Split(v, ",")...)
+					}
+					args[n] = flat
+				case strings.Contains(vs[0], ","):
+					args[n] = strings.Split(vs[0], ",")
+				case vs[0] != "":
+					args[n] = vs[0]
+				}
+				if _, ok := args[n]; ok {
+					continue
+				}
 			}
 			if v, ok := jsonargs[n]; ok {
 				args[n] = v
@@ -212,7 +440,13 @@ func MkHandler(db *sql.DB, query string) (http.Handler, error) {
 			}
 		}
 		// TBD: what if not all names set? can postgres $n deal with nil?
-		n, err := qf(args, w)
+		rows, err := qs.query(r.Context(), args)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		mimeType, enc := negotiateEncoder(r.Header.Get("Accept"))
+		n, err := stream(rows, enc, mimeType+";charset=UTF-8", w)
 		if err != nil {
 			if n == 0 {
 				http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -0,0 +1,56 @@
+package migrate
+
+// dialect holds the handful of SQL statements the Migrator needs to
+// manage schema_migrations, in the syntax the target driver accepts.
+type dialect struct {
+	createTable   string
+	insertVersion string // params: version, checksum
+	deleteVersion string // params: version
+	selectAll     string
+}
+
+var pqDialect = dialect{
+	createTable: `CREATE TABLE IF NOT EXISTS schema_migrations (
+		version bigint PRIMARY KEY,
+		applied_at timestamptz NOT NULL DEFAULT now(),
+		checksum text NOT NULL
+	)`,
+	insertVersion: `INSERT INTO schema_migrations (version, applied_at, checksum) VALUES ($1, now(), $2)`,
+	deleteVersion: `DELETE FROM schema_migrations WHERE version = $1`,
+	selectAll:     `SELECT version, applied_at, checksum FROM schema_migrations ORDER BY version`,
+}
+
+var mysqlDialect = dialect{
+	createTable: `CREATE TABLE IF NOT EXISTS schema_migrations (
+		version BIGINT PRIMARY KEY,
+		applied_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		checksum VARCHAR(64) NOT NULL
+	)`,
+	insertVersion: `INSERT INTO schema_migrations (version, applied_at, checksum) VALUES (?, CURRENT_TIMESTAMP, ?)`,
+	deleteVersion: `DELETE FROM schema_migrations WHERE version = ?`,
+	selectAll:     `SELECT version, applied_at, checksum FROM schema_migrations ORDER BY version`,
+}
+
+// questionDialect covers sqlite3 and anything else we don't recognize;
+// it uses '?' placeholders and types every driver's SQL understands.
+var questionDialect = dialect{
+	createTable: `CREATE TABLE IF NOT EXISTS schema_migrations (
+		version INTEGER PRIMARY KEY,
+		applied_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		checksum TEXT NOT NULL
+	)`,
+	insertVersion: `INSERT INTO schema_migrations (version, applied_at, checksum) VALUES (?, CURRENT_TIMESTAMP, ?)`,
+	deleteVersion: `DELETE FROM schema_migrations WHERE version = ?`,
+	selectAll:     `SELECT version, applied_at, checksum FROM schema_migrations ORDER BY version`,
+}
+
+func dialectFor(driver string) dialect {
+	switch driver {
+	case "pq", "pgx":
+		return pqDialect
+	case "mysql":
+		return mysqlDialect
+	default:
+		return questionDialect
+	}
+}
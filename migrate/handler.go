@@ -0,0 +1,47 @@
+package migrate
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// An AuthFunc decides whether a request may trigger a migration run. It
+// returns false to reject the request with 403 Forbidden.
+type AuthFunc func(r *http.Request) bool
+
+// Handler returns an http.Handler that reports m.Status() as JSON on
+// GET, and, once auth(r) allows it, runs m.Up() on POST -- so a service
+// can expose its own migration status and self-migrate on startup or
+// deploy through the same binary that serves its queries via
+// jsql.MkHandler. auth may be nil to allow every request, e.g. behind
+// infrastructure that already restricts access to this route.
+func Handler(m *Migrator, auth AuthFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			writeStatus(w, r, m)
+		case http.MethodPost:
+			if auth != nil && !auth(r) {
+				http.Error(w, "forbidden", http.StatusForbidden)
+				return
+			}
+			if err := m.Up(r.Context()); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			writeStatus(w, r, m)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+}
+
+func writeStatus(w http.ResponseWriter, r *http.Request, m *Migrator) {
+	statuses, err := m.Status(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json;charset=UTF-8")
+	json.NewEncoder(w).Encode(statuses)
+}
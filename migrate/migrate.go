@@ -0,0 +1,347 @@
+// Package migrate manages schema versions from a directory (or any
+// fs.FS) of files named "NNNN_name.up.sql" / "NNNN_name.down.sql", in
+// the spirit of pressly/goose and mattes/migrate.
+package migrate
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"hash/fnv"
+	"io/fs"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/lvdlvd/go-jsql"
+)
+
+// A Migration is one versioned schema change, read from a matching pair
+// of "NNNN_name.up.sql" / "NNNN_name.down.sql" files.
+type Migration struct {
+	Version int64
+	Name    string
+
+	upSQL    string
+	downSQL  string
+	checksum string
+}
+
+// A Migrator applies Migrations from a source to a database, tracking
+// which have already been applied in a schema_migrations table.
+type Migrator struct {
+	db         *sql.DB
+	driver     string
+	dialect    dialect
+	migrations []Migration // sorted by Version, ascending
+}
+
+var reMigrationFile = regexp.MustCompile(`^(\d+)_(.+)\.(up|down)\.sql$`)
+
+// New reads the migrations out of source and prepares a Migrator for
+// db. It does not touch the database until Up, Down, Migrate or Status
+// is called.
+func New(db *sql.DB, source fs.FS) (*Migrator, error) {
+	entries, err := fs.ReadDir(source, ".")
+	if err != nil {
+		return nil, fmt.Errorf("migrate: reading source: %w", err)
+	}
+
+	byVersion := map[int64]*Migration{}
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+		m := reMigrationFile.FindStringSubmatch(e.Name())
+		if m == nil {
+			continue
+		}
+		version, err := strconv.ParseInt(m[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("migrate: bad version in %q: %w", e.Name(), err)
+		}
+		b, err := fs.ReadFile(source, e.Name())
+		if err != nil {
+			return nil, fmt.Errorf("migrate: reading %q: %w", e.Name(), err)
+		}
+
+		mig := byVersion[version]
+		if mig == nil {
+			mig = &Migration{Version: version, Name: m[2]}
+			byVersion[version] = mig
+		} else if mig.Name != m[2] {
+			return nil, fmt.Errorf("migrate: version %d has mismatched names %q and %q", version, mig.Name, m[2])
+		}
+		switch m[3] {
+		case "up":
+			mig.upSQL = string(b)
+		case "down":
+			mig.downSQL = string(b)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, mig := range byVersion {
+		if mig.upSQL == "" {
+			return nil, fmt.Errorf("migrate: version %d (%s) has no .up.sql", mig.Version, mig.Name)
+		}
+		mig.checksum = checksum(mig.upSQL)
+		migrations = append(migrations, *mig)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+
+	driver := jsql.DriverName(db.Driver())
+	return &Migrator{db: db, driver: driver, dialect: dialectFor(driver), migrations: migrations}, nil
+}
+
+// A Status describes one Migration's state in the database.
+type Status struct {
+	Version   int64
+	Name      string
+	Applied   bool
+	AppliedAt time.Time
+	Checksum  string
+}
+
+// Status reports every known Migration and whether it has been applied.
+func (m *Migrator) Status(ctx context.Context) ([]Status, error) {
+	if err := m.ensureSchema(ctx); err != nil {
+		return nil, err
+	}
+	applied, err := m.appliedVersions(ctx)
+	if err != nil {
+		return nil, err
+	}
+	statuses := make([]Status, len(m.migrations))
+	for i, mig := range m.migrations {
+		s := Status{Version: mig.Version, Name: mig.Name}
+		if row, ok := applied[mig.Version]; ok {
+			s.Applied = true
+			s.AppliedAt = row.appliedAt
+			s.Checksum = row.checksum
+		}
+		statuses[i] = s
+	}
+	return statuses, nil
+}
+
+// Up migrates to the most recent version known to the Migrator.
+func (m *Migrator) Up(ctx context.Context) error {
+	if len(m.migrations) == 0 {
+		return nil
+	}
+	return m.Migrate(ctx, m.migrations[len(m.migrations)-1].Version)
+}
+
+// Down rolls back the single most recently applied migration.
+func (m *Migrator) Down(ctx context.Context) error {
+	return m.migrate(ctx, downTarget)
+}
+
+// downTarget picks Down's target version from a snapshot of what's
+// applied: the second-most-recent version, so Migrate rolls back only
+// the most recent one. ok is false if nothing is applied, meaning Down
+// has nothing to do.
+func downTarget(applied map[int64]appliedRow) (target int64, ok bool) {
+	if len(applied) == 0 {
+		return 0, false
+	}
+	versions := make([]int64, 0, len(applied))
+	for v := range applied {
+		versions = append(versions, v)
+	}
+	sort.Slice(versions, func(i, j int) bool { return versions[i] < versions[j] })
+	if len(versions) > 1 {
+		target = versions[len(versions)-2]
+	}
+	return target, true
+}
+
+// Migrate brings the database to exactly targetVersion, running
+// .up.sql files for versions <= targetVersion not yet applied, and
+// .down.sql files (newest first) for applied versions > targetVersion.
+// It takes an advisory lock for the duration of the run so that
+// concurrent processes migrating the same database don't race.
+func (m *Migrator) Migrate(ctx context.Context, targetVersion int64) error {
+	return m.migrate(ctx, func(map[int64]appliedRow) (int64, bool) { return targetVersion, true })
+}
+
+// migrate is Migrate generalized to a target picked by selectTarget from
+// a snapshot of applied versions taken after the advisory lock is held,
+// rather than one the caller computed beforehand. Down needs to know
+// what's currently applied to pick its target; reading that before the
+// lock (as Migrate's caller would have to) lets a concurrent Down/Up/
+// Migrate change what's applied in between, racing the very thing the
+// lock exists to prevent. selectTarget returns ok == false to mean
+// "nothing to do".
+func (m *Migrator) migrate(ctx context.Context, selectTarget func(applied map[int64]appliedRow) (target int64, ok bool)) error {
+	unlock, err := m.lock(ctx)
+	if err != nil {
+		return err
+	}
+	defer unlock(ctx)
+
+	if err := m.ensureSchema(ctx); err != nil {
+		return err
+	}
+	applied, err := m.appliedVersions(ctx)
+	if err != nil {
+		return err
+	}
+	targetVersion, ok := selectTarget(applied)
+	if !ok {
+		return nil
+	}
+
+	for _, mig := range m.migrations {
+		if mig.Version > targetVersion {
+			break
+		}
+		if _, ok := applied[mig.Version]; !ok {
+			if err := m.run(ctx, mig, true); err != nil {
+				return err
+			}
+		}
+	}
+	for i := len(m.migrations) - 1; i >= 0; i-- {
+		mig := m.migrations[i]
+		if mig.Version <= targetVersion {
+			continue
+		}
+		if _, ok := applied[mig.Version]; ok {
+			if err := m.run(ctx, mig, false); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// run applies (up) or reverts (!up) one migration in its own
+// transaction, recording or removing it from schema_migrations.
+func (m *Migrator) run(ctx context.Context, mig Migration, up bool) error {
+	stmt := mig.upSQL
+	if !up {
+		stmt = mig.downSQL
+		if stmt == "" {
+			return fmt.Errorf("migrate: version %d (%s) has no .down.sql", mig.Version, mig.Name)
+		}
+	}
+
+	tx, err := m.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, stmt); err != nil {
+		tx.Rollback()
+		return fmt.Errorf("migrate: version %d (%s): %w", mig.Version, mig.Name, err)
+	}
+	if up {
+		_, err = tx.ExecContext(ctx, m.dialect.insertVersion, mig.Version, mig.checksum)
+	} else {
+		_, err = tx.ExecContext(ctx, m.dialect.deleteVersion, mig.Version)
+	}
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("migrate: version %d (%s): recording schema_migrations: %w", mig.Version, mig.Name, err)
+	}
+	return tx.Commit()
+}
+
+func (m *Migrator) ensureSchema(ctx context.Context) error {
+	_, err := m.db.ExecContext(ctx, m.dialect.createTable)
+	return err
+}
+
+type appliedRow struct {
+	appliedAt time.Time
+	checksum  string
+}
+
+func (m *Migrator) appliedVersions(ctx context.Context) (map[int64]appliedRow, error) {
+	rows, err := m.db.QueryContext(ctx, m.dialect.selectAll)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	out := map[int64]appliedRow{}
+	for rows.Next() {
+		var (
+			v int64
+			a time.Time
+			c string
+		)
+		if err := rows.Scan(&v, &a, &c); err != nil {
+			return nil, err
+		}
+		out[v] = appliedRow{appliedAt: a, checksum: c}
+	}
+	return out, rows.Err()
+}
+
+// lockName identifies this package's advisory lock across processes and
+// drivers that lock by name (mysql's GET_LOCK) or by integer key
+// (postgres' pg_advisory_lock).
+const lockName = "github.com/lvdlvd/go-jsql/migrate"
+
+var lockKey = func() int64 {
+	h := fnv.New64a()
+	h.Write([]byte(lockName))
+	return int64(h.Sum64())
+}()
+
+type unlockFunc func(context.Context) error
+
+// lock takes a lock around a migration run so concurrent processes
+// don't race: pg_advisory_lock on postgres, GET_LOCK on mysql, and a
+// sentinel row elsewhere.
+func (m *Migrator) lock(ctx context.Context) (unlockFunc, error) {
+	switch m.driver {
+	case "pq", "pgx":
+		if _, err := m.db.ExecContext(ctx, `SELECT pg_advisory_lock($1)`, lockKey); err != nil {
+			return nil, err
+		}
+		return func(ctx context.Context) error {
+			_, err := m.db.ExecContext(ctx, `SELECT pg_advisory_unlock($1)`, lockKey)
+			return err
+		}, nil
+	case "mysql":
+		var got int
+		if err := m.db.QueryRowContext(ctx, `SELECT GET_LOCK(?, 30)`, lockName).Scan(&got); err != nil {
+			return nil, err
+		}
+		if got != 1 {
+			return nil, fmt.Errorf("migrate: could not acquire GET_LOCK(%q)", lockName)
+		}
+		return func(ctx context.Context) error {
+			_, err := m.db.ExecContext(ctx, `SELECT RELEASE_LOCK(?)`, lockName)
+			return err
+		}, nil
+	default:
+		return m.sentinelLock(ctx)
+	}
+}
+
+// sentinelLock is the fallback locking strategy for drivers with no
+// dedicated advisory-lock primitive: a single sentinel row that only
+// one migration run can hold at a time.
+func (m *Migrator) sentinelLock(ctx context.Context) (unlockFunc, error) {
+	if _, err := m.db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations_lock (id INTEGER PRIMARY KEY)`); err != nil {
+		return nil, err
+	}
+	if _, err := m.db.ExecContext(ctx, `INSERT INTO schema_migrations_lock (id) VALUES (1)`); err != nil {
+		return nil, fmt.Errorf("migrate: another migration appears to be running: %w", err)
+	}
+	return func(ctx context.Context) error {
+		_, err := m.db.ExecContext(ctx, `DELETE FROM schema_migrations_lock WHERE id = 1`)
+		return err
+	}, nil
+}
+
+func checksum(sql string) string {
+	h := fnv.New64a()
+	h.Write([]byte(sql))
+	return strconv.FormatUint(h.Sum64(), 16)
+}
@@ -0,0 +1,24 @@
+package migrate
+
+import "testing"
+
+func TestDownTarget(t *testing.T) {
+	cases := []struct {
+		name       string
+		applied    map[int64]appliedRow
+		wantTarget int64
+		wantOK     bool
+	}{
+		{"nothing applied", map[int64]appliedRow{}, 0, false},
+		{"one applied", map[int64]appliedRow{1: {}}, 0, true},
+		{"three applied", map[int64]appliedRow{1: {}, 2: {}, 3: {}}, 2, true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			target, ok := downTarget(c.applied)
+			if ok != c.wantOK || target != c.wantTarget {
+				t.Errorf("downTarget(%v) = (%d, %v), want (%d, %v)", c.applied, target, ok, c.wantTarget, c.wantOK)
+			}
+		})
+	}
+}
@@ -0,0 +1,197 @@
+package jsql
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+// ExecResult is the JSON object written by an ExecFunc.
+type ExecResult struct {
+	RowsAffected int64 `json:"rows_affected"`
+	LastInsertId int64 `json:"last_insert_id"`
+}
+
+// An ExecFunc is the type of function generated by Exec. It runs an
+// INSERT/UPDATE/DELETE substituting arguments from the provided args
+// map, and writes the resulting ExecResult as json to w.
+type ExecFunc func(args map[string]interface{}, w io.Writer) (ExecResult, error)
+
+// Exec is the write counterpart to Q: it builds a function that runs an
+// INSERT/UPDATE/DELETE query of the same '${varname}' form Q accepts,
+// via stmt.ExecContext rather than Query, and writes
+// {"rows_affected":N,"last_insert_id":M} to w. Drivers that don't
+// support LastInsertId (e.g. postgres) report 0 there; use
+// ExecReturning to get values back from postgres-style
+// "INSERT ... RETURNING" instead.
+func Exec(db *sql.DB, query string) (ExecFunc, error) {
+	qs, err := prepareQuery(context.Background(), db, query)
+	if err != nil {
+		return nil, err
+	}
+	return func(args map[string]interface{}, w io.Writer) (ExecResult, error) {
+		res, err := qs.exec(context.Background(), args)
+		if err != nil {
+			return ExecResult{}, err
+		}
+		result, err := execResult(res)
+		if err != nil {
+			return result, err
+		}
+		if err := writeExecResult(w, result); err != nil {
+			return result, err
+		}
+		return result, nil
+	}, nil
+}
+
+func execResult(res sql.Result) (ExecResult, error) {
+	ra, err := res.RowsAffected()
+	if err != nil {
+		return ExecResult{}, err
+	}
+	li, _ := res.LastInsertId() // not supported by e.g. postgres; leave 0
+	return ExecResult{RowsAffected: ra, LastInsertId: li}, nil
+}
+
+func writeExecResult(w io.Writer, result ExecResult) error {
+	b, err := json.Marshal(result)
+	if err != nil {
+		return err
+	}
+	if rw, ok := w.(http.ResponseWriter); ok {
+		rw.Header().Set("Content-type", jsonContentType)
+	}
+	_, err = w.Write(b)
+	return err
+}
+
+// ExecReturning is like Q, for postgres-style "INSERT/UPDATE/DELETE ...
+// RETURNING ..." queries: since the driver runs these through Query
+// rather than Exec, ExecReturning is Q under a name that says what it's
+// for.
+func ExecReturning(db *sql.DB, query string) (QueryFunc, error) {
+	return Q(db, query)
+}
+
+// MkMutationHandler produces a http.Handler around Exec that only
+// accepts POST, PUT and DELETE. A JSON object body supplies the query's
+// arguments the same way MkHandler's does; a JSON array body runs the
+// statement once per element inside a single transaction, rolling back
+// on the first error, so a batch either fully applies or not at all.
+func MkMutationHandler(db *sql.DB, query string) (http.Handler, error) {
+	qs, err := prepareQuery(context.Background(), db, query)
+	if err != nil {
+		return nil, err
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodPost, http.MethodPut, http.MethodDelete:
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		muxargs := mux.Vars(r)
+
+		var items []map[string]interface{}
+		if r.ContentLength != 0 {
+			defer r.Body.Close()
+			raw, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if err := json.Unmarshal(raw, &items); err != nil {
+				var obj map[string]interface{}
+				if len(raw) > 0 {
+					if err := json.Unmarshal(raw, &obj); err != nil {
+						http.Error(w, "Can't decode json request: "+err.Error(), http.StatusBadRequest)
+						return
+					}
+				}
+				items = []map[string]interface{}{obj}
+			}
+		} else {
+			items = []map[string]interface{}{nil}
+		}
+
+		if len(items) == 1 {
+			args := mergeArgs(qs.argn, items[0], muxargs)
+			res, err := qs.exec(r.Context(), args)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			result, err := execResult(res)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if err := writeExecResult(w, result); err != nil {
+				log.Print(r.Method, r.URL, ": ", err)
+			}
+			return
+		}
+
+		tx, err := db.BeginTx(r.Context(), nil)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		var total ExecResult
+		txStmts := map[*sql.Stmt]*sql.Stmt{} // qs.stmt/variant -> its tx-scoped statement, prepared once per batch
+		for _, item := range items {
+			args := mergeArgs(qs.argn, item, muxargs)
+			stmt, argv, err := qs.prepared(r.Context(), args)
+			if err != nil {
+				tx.Rollback()
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			txStmt, ok := txStmts[stmt]
+			if !ok {
+				txStmt = tx.StmtContext(r.Context(), stmt)
+				txStmts[stmt] = txStmt
+			}
+			res, err := txStmt.ExecContext(r.Context(), argv...)
+			if err != nil {
+				tx.Rollback()
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			ra, _ := res.RowsAffected()
+			total.RowsAffected += ra
+		}
+		if err := tx.Commit(); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if err := writeExecResult(w, total); err != nil {
+			log.Print(r.Method, r.URL, ": ", err)
+		}
+	}), nil
+}
+
+// mergeArgs extracts the query's named arguments out of a decoded JSON
+// object, with muxargs (path variables from "github.com/gorilla/mux")
+// taking precedence, the same way MkHandler merges request arguments.
+func mergeArgs(names []string, item map[string]interface{}, muxargs map[string]string) map[string]interface{} {
+	args := make(map[string]interface{}, len(names))
+	for _, n := range names {
+		if v, ok := muxargs[n]; ok {
+			args[n] = v
+			continue
+		}
+		if v, ok := item[n]; ok {
+			args[n] = v
+		}
+	}
+	return args
+}
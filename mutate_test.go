@@ -0,0 +1,135 @@
+package jsql
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"io"
+	"sync"
+	"testing"
+)
+
+// fakeMutateDriver is a minimal database/sql driver used to exercise
+// query/exec arity expansion and the queryStmt.variants cache without a
+// real database, following the approach in .claude/skills/verify.
+type fakeMutateDriver struct{}
+
+func (fakeMutateDriver) Open(name string) (driver.Conn, error) { return &fakeMutateConn{}, nil }
+
+type fakeMutateConn struct {
+	mu       sync.Mutex
+	prepared []string // every query text passed to Prepare, in order
+}
+
+func (c *fakeMutateConn) Prepare(query string) (driver.Stmt, error) {
+	c.mu.Lock()
+	c.prepared = append(c.prepared, query)
+	c.mu.Unlock()
+	return &fakeMutateStmt{}, nil
+}
+func (c *fakeMutateConn) Close() error              { return nil }
+func (c *fakeMutateConn) Begin() (driver.Tx, error) { return fakeMutateTx{}, nil }
+
+type fakeMutateStmt struct{ closed bool }
+
+func (s *fakeMutateStmt) Close() error  { s.closed = true; return nil }
+func (s *fakeMutateStmt) NumInput() int { return -1 } // accept any argv length
+func (s *fakeMutateStmt) Exec(args []driver.Value) (driver.Result, error) {
+	return fakeMutateResult{rows: int64(len(args))}, nil
+}
+func (s *fakeMutateStmt) Query(args []driver.Value) (driver.Rows, error) {
+	return fakeMutateRows{}, nil
+}
+
+type fakeMutateResult struct{ rows int64 }
+
+func (r fakeMutateResult) LastInsertId() (int64, error) { return 0, nil }
+func (r fakeMutateResult) RowsAffected() (int64, error) { return r.rows, nil }
+
+type fakeMutateRows struct{}
+
+func (fakeMutateRows) Columns() []string              { return nil }
+func (fakeMutateRows) Close() error                   { return nil }
+func (fakeMutateRows) Next(dest []driver.Value) error { return io.EOF }
+
+type fakeMutateTx struct{}
+
+func (fakeMutateTx) Commit() error   { return nil }
+func (fakeMutateTx) Rollback() error { return nil }
+
+var fakeMutateDriverOnce sync.Once
+
+func openFakeMutateDB(t *testing.T) *sql.DB {
+	t.Helper()
+	fakeMutateDriverOnce.Do(func() { sql.Register("jsql-fake-mutate", fakeMutateDriver{}) })
+	db, err := Open("jsql-fake-mutate", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	RegisterBindType("jsql-fake-mutate", QUESTION)
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func TestExecExpandsSliceArgs(t *testing.T) {
+	db := openFakeMutateDB(t)
+
+	execFn, err := Exec(db, "DELETE FROM foo WHERE id IN (${ids})")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := execFn(map[string]interface{}{"ids": []int{1, 2, 3}}, io.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.RowsAffected != 3 {
+		t.Errorf("RowsAffected = %d, want 3 (one bound arg per element of ids)", res.RowsAffected)
+	}
+}
+
+func TestExecExpandsSingleElementSliceArg(t *testing.T) {
+	db := openFakeMutateDB(t)
+
+	execFn, err := Exec(db, "DELETE FROM foo WHERE id IN (${ids})")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A length-1 slice must still be indexed into, not bound as-is: the
+	// driver only ever sees scalar driver.Value args, never a []int.
+	res, err := execFn(map[string]interface{}{"ids": []int{5}}, io.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.RowsAffected != 1 {
+		t.Errorf("RowsAffected = %d, want 1", res.RowsAffected)
+	}
+}
+
+func TestPreparedForArityEvictsLeastRecentlyUsed(t *testing.T) {
+	db := openFakeMutateDB(t)
+
+	qs, err := prepareQuery(context.Background(), db, "DELETE FROM foo WHERE id IN (${ids})")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const firstArity = 1
+	for i := firstArity; i < firstArity+maxQueryVariants+5; i++ {
+		ids := make([]int, i)
+		if _, err := qs.exec(context.Background(), map[string]interface{}{"ids": ids}); err != nil {
+			t.Fatalf("exec with %d ids: %v", i, err)
+		}
+	}
+
+	if got := len(qs.variants); got != maxQueryVariants {
+		t.Errorf("len(qs.variants) = %d, want %d", got, maxQueryVariants)
+	}
+
+	// The arity used first should have been evicted, since every call
+	// after it used a distinct, never-repeated arity.
+	if _, ok := qs.variants[aritySignature(map[string]int{"ids": firstArity})]; ok {
+		t.Errorf("least-recently-used variant (arity %d) was not evicted", firstArity)
+	}
+}
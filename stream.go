@@ -0,0 +1,96 @@
+package jsql
+
+import (
+	"database/sql"
+	"io"
+	"net/http"
+)
+
+// scanRows starts a goroutine that scans rows and sends each one, as a
+// slice of column values in column order, on the returned channel. It
+// closes that channel and rows.Close()s when done: either the rows are
+// exhausted, a Scan fails, or done is closed by the caller to abandon
+// the scan early. Exactly one value -- the terminal error, or nil -- is
+// always sent on the returned error channel, on every one of those
+// exits, so a caller can always safely wait for it.
+//
+// This is the same producer used by QTmplContext's Results channel, so
+// Q and QTmpl share one core instead of reimplementing the scan loop.
+func scanRows(rows *sql.Rows, cols []string, done <-chan struct{}) (<-chan []interface{}, <-chan error) {
+	datach := make(chan []interface{})
+	errch := make(chan error, 1)
+	go func() {
+		defer rows.Close()
+		defer close(datach)
+		retvv := make([]interface{}, len(cols))
+		for rows.Next() {
+			retv := make([]interface{}, len(cols))
+			for i := range retv {
+				retvv[i] = &retv[i]
+			}
+			if err := rows.Scan(retvv...); err != nil {
+				errch <- err
+				return
+			}
+			// convert []byte to strings, because json uuencodes []byte
+			for i, v := range retv {
+				if vv, ok := v.([]byte); ok {
+					retv[i] = string(vv)
+				}
+			}
+			select {
+			case datach <- retv:
+			case <-done:
+				errch <- nil
+				return
+			}
+		}
+		errch <- rows.Err()
+	}()
+	return datach, errch
+}
+
+// stream drains rows through scanRows and feeds each row to enc,
+// setting contentType on w if it is an http.ResponseWriter before the
+// first row is written. It returns the number of rows written and any
+// error.
+//
+// As with the original Q, if n == 0 nothing is written at all -- not
+// even the encoder's header -- so an error can still become an
+// http.Error; once a header has been written, stream guarantees the
+// encoder's footer follows, even if a later row fails.
+func stream(rows *sql.Rows, enc Encoder, contentType string, w io.Writer) (n int, err error) {
+	cols, err := rows.Columns()
+	if err != nil {
+		rows.Close()
+		return 0, err
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	datach, errch := scanRows(rows, cols, done)
+
+	rowm := make(map[string]interface{}, len(cols))
+	for row := range datach {
+		for i, c := range cols {
+			rowm[c] = row[i]
+		}
+
+		if n == 0 {
+			if rw, ok := w.(http.ResponseWriter); ok && contentType != "" {
+				rw.Header().Set("Content-Type", contentType)
+			}
+			if err := enc.WriteHeader(cols, w); err != nil {
+				return n, err
+			}
+			defer enc.WriteFooter(w)
+		}
+
+		if err := enc.WriteRow(rowm, w); err != nil {
+			return n, err
+		}
+		n++
+	}
+
+	return n, <-errch
+}
@@ -1,6 +1,7 @@
 package jsql
 
 import (
+	"context"
 	"database/sql"
 	"html/template"
 	"io"
@@ -9,74 +10,76 @@ import (
 // A QueryTmplFunc is the type of function returned by QTmpl.
 // It takes a template, in addition to a writer.  The template
 // is invoked with the following argument:
-//     struct {
-//         Args: args                     // the arguments passed in
-//         Results: <-chan []interface{}   // a chanel of records corresponding to the querys results
-//     }
 //
+//	struct {
+//	    Args: args                     // the arguments passed in
+//	    Results: <-chan []interface{}   // a chanel of records corresponding to the querys results
+//	}
 type QueryTmplFunc func(args map[string]interface{}, tmpl template.Template, w io.Writer) error
 
-// QTmpl is like Q, but it returns a QueryTmplFunc
+// A QueryTmplCtxFunc is the type of function returned by QTmplContext.
+// It behaves like a QueryTmplFunc, but ctx is passed to the underlying
+// stmt.QueryContext.
+type QueryTmplCtxFunc func(ctx context.Context, args map[string]interface{}, tmpl template.Template, w io.Writer) error
+
+// QTmpl is like Q, but it returns a QueryTmplFunc.
+//
+// QTmpl is a thin wrapper around QTmplContext using context.Background().
 func QTmpl(db *sql.DB, query string) (QueryTmplFunc, error) {
-	q, argn := rewrite(query)
-	stmt, err := db.Prepare(q)
+	qf, err := QTmplContext(context.Background(), db, query)
 	if err != nil {
 		return nil, err
 	}
 	return func(args map[string]interface{}, tmpl template.Template, w io.Writer) error {
-		var argv []interface{}
-		for _, v := range argn {
-			argv = append(argv, args[v])
-		}
-		rows, err := stmt.Query(argv...)
+		return qf(context.Background(), args, tmpl, w)
+	}, nil
+}
+
+// QTmplContext is like QTmpl, but ctx is used to prepare the statement,
+// and the returned QueryTmplCtxFunc takes a ctx of its own for every
+// query.
+func QTmplContext(ctx context.Context, db *sql.DB, query string) (QueryTmplCtxFunc, error) {
+	qs, err := prepareQuery(ctx, db, query)
+	if err != nil {
+		return nil, err
+	}
+	return func(ctx context.Context, args map[string]interface{}, tmpl template.Template, w io.Writer) error {
+		rows, err := qs.query(ctx, args)
 		if err != nil {
 			return err
 		}
-		defer rows.Close()
-		retn, err := rows.Columns()
+		cols, err := rows.Columns()
 		if err != nil {
+			rows.Close()
 			return err
 		}
 
-		datach, errch := make(chan []interface{}), make(chan error, 1)
+		done := make(chan struct{})
+		datach, errch := scanRows(rows, cols, done)
 
+		terrch := make(chan error, 1)
 		go func() {
-			errch <- tmpl.Execute(w, struct {
+			terrch <- tmpl.Execute(w, struct {
 				Args    map[string]interface{}
 				Results <-chan []interface{}
 			}{args, datach})
 		}()
 
-		retvv := make([]interface{}, len(retn))
-		for rows.Next() {
-			retv := make([]interface{}, len(retn))
-			for i := range retv {
-				retvv[i] = &retv[i]
-			}
-			if err := rows.Scan(retvv...); err != nil {
-				close(datach)
-				return err
+		select {
+		case terr := <-terrch:
+			// early exit from the template: stop scanning and drain the
+			// scanner's goroutine so it can close rows.
+			close(done)
+			<-errch
+			return terr
+		case serr := <-errch:
+			// rows exhausted (or failed) before the template noticed;
+			// wait for it to finish consuming what's left.
+			terr := <-terrch
+			if serr != nil {
+				return serr
 			}
-			// convert []byte to strings
-			for i, v := range retv {
-				if vv, ok := v.([]byte); ok {
-					retv[i] = string(vv)
-				}
-			}
-
-			select {
-			case err := <-errch:
-				// early exit from the template
-				return err
-			case datach <- retv:
-				// nix
-			}
-		}
-		close(datach)                      // will exit the template
-		terr := <-errch                    // wait for it, or it may not be done writing
-		if err := rows.Err(); err != nil { // db error trumps
-			return err
+			return terr
 		}
-		return terr
 	}, nil
 }